@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// manifestRecord is one row of the manifest-of-manifests: which output was
+// generated from an input, and the input's content hash at generation time.
+type manifestRecord struct {
+	Hash   string
+	Output string
+}
+
+// hashFile hashes a source file's content together with salt, a fingerprint
+// of the generation options (namespace, labels, annotations, validation mode)
+// that influence its output. Folding salt in means changing those options
+// invalidates the cache the same way changing the input file would.
+func hashFile(path, salt string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write(b)
+	h.Write([]byte(salt))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// mapFingerprint produces a deterministic string representation of a string
+// map, suitable for folding into hashFile's salt.
+func mapFingerprint(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b := strings.Builder{}
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteString("=")
+		b.WriteString(m[k])
+		b.WriteString(";")
+	}
+	return b.String()
+}
+
+// loadManifestIndex reads the `.manifests` file in manifestsDir. Lines from
+// before this index existed (bare paths, no hash/output) are loaded with an
+// empty Hash so they always fail the up-to-date check and get regenerated.
+func loadManifestIndex(manifestsDir string) (map[string]manifestRecord, error) {
+	idx := map[string]manifestRecord{}
+	f, err := os.Open(filepath.Join(manifestsDir, ".manifests"))
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			continue
+		}
+		parts := strings.Split(line, "\t")
+		if len(parts) != 3 {
+			idx[parts[0]] = manifestRecord{}
+			continue
+		}
+		idx[parts[0]] = manifestRecord{Hash: parts[1], Output: parts[2]}
+	}
+	return idx, s.Err()
+}
+
+// writeManifestIndex overwrites the `.manifests` file with one
+// "path\tsha256\toutput" line per record, sorted by path so the output stays
+// deterministic run to run.
+func writeManifestIndex(manifestsDir string, idx map[string]manifestRecord) error {
+	paths := make([]string, 0, len(idx))
+	for p := range idx {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	b := strings.Builder{}
+	for _, p := range paths {
+		r := idx[p]
+		b.WriteString(fmt.Sprintf("%s\t%s\t%s\n", p, r.Hash, r.Output))
+	}
+	return os.WriteFile(filepath.Join(manifestsDir, ".manifests"), []byte(b.String()), 0644)
+}
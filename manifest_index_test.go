@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashFileFoldsInSalt(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "f.json")
+	if err := os.WriteFile(p, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h1, err := hashFile(p, "salt-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := hashFile(p, "salt-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h1 == h2 {
+		t.Error("expected different salts to produce different hashes for the same content")
+	}
+
+	h1Again, err := hashFile(p, "salt-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h1 != h1Again {
+		t.Error("expected the same content+salt to hash deterministically")
+	}
+}
+
+func TestMapFingerprintIsOrderIndependent(t *testing.T) {
+	a := map[string]string{"team": "a", "env": "prod"}
+	b := map[string]string{"env": "prod", "team": "a"}
+	if mapFingerprint(a) != mapFingerprint(b) {
+		t.Error("expected mapFingerprint to be independent of map iteration order")
+	}
+	if mapFingerprint(map[string]string{"team": "a"}) == mapFingerprint(map[string]string{"team": "b"}) {
+		t.Error("expected different maps to produce different fingerprints")
+	}
+}
+
+func TestManifestIndexRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	idx := map[string]manifestRecord{
+		"/in/b.json": {Hash: "hb", Output: "/out/b.yaml"},
+		"/in/a.json": {Hash: "ha", Output: "/out/a.yaml"},
+	}
+	if err := writeManifestIndex(dir, idx); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadManifestIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(idx) {
+		t.Fatalf("got %d records, want %d", len(got), len(idx))
+	}
+	for p, r := range idx {
+		if got[p] != r {
+			t.Errorf("record for %s = %+v, want %+v", p, got[p], r)
+		}
+	}
+}
+
+func TestLoadManifestIndexMissingFile(t *testing.T) {
+	idx, err := loadManifestIndex(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx) != 0 {
+		t.Errorf("expected an empty index, got %d records", len(idx))
+	}
+}
+
+func TestLoadManifestIndexOldFormat(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".manifests"), []byte("/in/a.json\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := loadManifestIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, ok := idx["/in/a.json"]
+	if !ok {
+		t.Fatal("expected old-format line to be loaded")
+	}
+	if r.Hash != "" {
+		t.Errorf("expected an empty hash for an old-format line, got %q", r.Hash)
+	}
+}
+
+func TestUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.yaml")
+	if err := os.WriteFile(out, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := map[string]manifestRecord{
+		"/in/a.json": {Hash: "h1", Output: out},
+	}
+
+	if !unchanged(old, "/in/a.json", "h1", out) {
+		t.Error("expected matching hash/output with an existing file to be unchanged")
+	}
+	if unchanged(old, "/in/a.json", "h2", out) {
+		t.Error("expected a different hash to be considered changed")
+	}
+	if unchanged(old, "/in/a.json", "h1", filepath.Join(dir, "other.yaml")) {
+		t.Error("expected a different output path to be considered changed")
+	}
+	if err := os.Remove(out); err != nil {
+		t.Fatal(err)
+	}
+	if unchanged(old, "/in/a.json", "h1", out) {
+		t.Error("expected a missing output file to be considered changed")
+	}
+}
+
+func TestRemoveStaleOutput(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "stale.yaml")
+	if err := os.WriteFile(stale, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	current := filepath.Join(dir, "current.yaml")
+	old := map[string]manifestRecord{
+		"/in/a.json": {Hash: "h1", Output: stale},
+	}
+
+	if err := removeStaleOutput(old, "/in/a.json", current); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("expected the stale output to be removed")
+	}
+
+	if err := removeStaleOutput(old, "/in/missing.json", current); err != nil {
+		t.Errorf("expected no error for an input with no prior record, got: %v", err)
+	}
+
+	if err := removeStaleOutput(map[string]manifestRecord{
+		"/in/a.json": {Hash: "h1", Output: current},
+	}, "/in/a.json", current); err != nil {
+		t.Errorf("expected no error when the output path is unchanged, got: %v", err)
+	}
+}
@@ -24,14 +24,19 @@ var (
 	k8sNamespace                         = kingpin.Flag("k8s.namespace", "k8s namespace for generated manifests").Short('n').Default("monitoring").String()
 	k8sLabels                            = kingpin.Flag("k8s.labels", "labels to add to the k8s manifests.").Short('l').StringMap()
 	rulesLabelsNoEnforceTeams            = kingpin.Flag("metadata.rulesLabelsNoEnforceTeams", "Enforce required team label from dir name for each rule in a rules file.").Short('r').Strings()
+	emit                                 = kingpin.Flag("emit", "Root kustomization kind to emit: base (a Kustomization other consumers point at with bases/resources) or component (a Component layered in via components:).").Default("base").Enum("base", "component")
+	validate                             = kingpin.Flag("validate", "Validate generated ConfigMaps/PrometheusRules against k8s/CRD JSON schemas before writing them: strict fails the run, warn only logs.").Default("").Enum("", "strict", "warn")
+	schemaLocation                       = kingpin.Flag("schema-location", "Directory of kubeconform-style JSON schema bundles (<kind>-<group>-<version>.json), required when --validate is set.").String()
+	watchMode                            = kingpin.Flag("watch", "After the initial run, watch the resolved dashboard/rules directories and regenerate affected outputs on change.").Bool()
 	isStringSpecialLowerCaseAlphaNumeric = regexp.MustCompile(`^[a-z0-9][a-z0-9-.]*[a-z0-9]$`).MatchString
 )
 
 type kustomizeFile struct {
 	APIVersion        string            `yaml:"apiVersion"`
 	Kind              string            `yaml:"kind"`
+	Namespace         string            `yaml:"namespace,omitempty"`
+	CommonLabels      map[string]string `yaml:"commonLabels,omitempty"`
 	CommonAnnotations map[string]string `yaml:"commonAnnotations,omitempty"`
-	Bases             []string          `yaml:"bases,omitempty"`
 	Resources         []string          `yaml:"resources,omitempty"`
 }
 
@@ -41,22 +46,37 @@ type Config struct {
 	K8sNamespace             string
 	K8sLabels                *map[string]string
 	RulesLabelsNoEnforceTeam *map[string]bool
+	Teams                    *map[string]bool
+	Validate                 string
+	SchemaLocation           string
+	OldIndex                 map[string]manifestRecord
+	NewIndex                 *map[string]manifestRecord
 }
 
-type DirProcessor func(dir string, c Config) error
-
-func cleanDir(dir string) error {
-	err := os.RemoveAll(dir)
-	if err != nil {
-		return err
-	}
-	err = os.MkdirAll(dir, 0775)
-	if err != nil {
-		return err
+// validateAndPlace validates a just-written manifest (written to tmp) against
+// its k8s/CRD schema and, if it passes (or Validate is off), moves it into
+// its final path. In strict mode a schema violation fails the run and the
+// temp file is removed instead of being placed.
+func (c Config) validateAndPlace(tmp, final, kind, group, version string) error {
+	if c.Validate != "" {
+		b, err := os.ReadFile(tmp)
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if verr := validateManifest(c.SchemaLocation, kind, group, version, b); verr != nil {
+			if c.Validate == "strict" {
+				os.Remove(tmp)
+				return fmt.Errorf("%s failed schema validation: %v", final, verr)
+			}
+			log.Warn().Msgf("%s failed schema validation: %v", final, verr)
+		}
 	}
-	return nil
+	return os.Rename(tmp, final)
 }
 
+type DirProcessor func(dir string, c Config) error
+
 func generateKustomizeResources(dir string) ([]string, error) {
 	resources := []string{}
 	d, err := os.Open(dir)
@@ -69,7 +89,7 @@ func generateKustomizeResources(dir string) ([]string, error) {
 		return []string{}, err
 	}
 	for _, entry := range entries {
-		if filepath.Ext(entry) == ".yaml" {
+		if filepath.Ext(entry) == ".yaml" && entry != "kustomization.yaml" {
 			resources = append(resources, entry)
 		}
 	}
@@ -78,26 +98,60 @@ func generateKustomizeResources(dir string) ([]string, error) {
 	return resources, nil
 }
 
-func generateKustomizeFile(dir string) error {
+func writeKustomizeFile(dir string, k kustomizeFile) error {
+	b := bytes.Buffer{}
+	e := yaml.NewEncoder(&b)
+	e.SetIndent(2)
+	err := e.Encode(&k)
+	if err != nil {
+		return err
+	}
+	kf := filepath.Join(dir, "kustomization.yaml")
+	return os.WriteFile(kf, b.Bytes(), 0666)
+}
+
+// generateTeamKustomizeFile writes a kustomization.yaml into a team's manifest
+// subdirectory listing that team's manifests, with team labels/annotations and
+// the namespace pushed into commonLabels/commonAnnotations/namespace instead of
+// being duplicated into every generated manifest. enforceTeamLabel mirrors the
+// metadata.rulesLabelsNoEnforceTeams opt-out: when false, the team label is
+// left out of commonLabels (commonAnnotations still carries team).
+func generateTeamKustomizeFile(dir, team, namespace string, enforceTeamLabel bool) error {
 	r, err := generateKustomizeResources(dir)
 	if err != nil {
 		return err
 	}
+	k := kustomizeFile{
+		Kind:              "Kustomization",
+		APIVersion:        "kustomize.config.k8s.io/v1beta1",
+		Namespace:         namespace,
+		CommonAnnotations: map[string]string{"team": team},
+		Resources:         r,
+	}
+	if enforceTeamLabel {
+		k.CommonLabels = map[string]string{"team": team}
+	}
+	return writeKustomizeFile(dir, k)
+}
+
+// generateRootKustomizeFile writes the top-level kustomization.yaml that composes
+// every per-team directory via resources (the modern replacement for the
+// deprecated bases field). When emit is "component" it writes a Kustomize
+// Component instead, so the output can be layered onto an existing
+// kustomization via components: rather than consumed as a base.
+func generateRootKustomizeFile(dir string, teams []string, emit string) error {
+	t := append([]string{}, teams...)
+	sort.Strings(t)
 	k := kustomizeFile{
 		Kind:       "Kustomization",
 		APIVersion: "kustomize.config.k8s.io/v1beta1",
-		Resources:  r,
+		Resources:  t,
 	}
-	b := bytes.Buffer{}
-	e := yaml.NewEncoder(&b)
-	e.SetIndent(2)
-	err = e.Encode(&k)
-	if err != nil {
-		return err
+	if emit == "component" {
+		k.Kind = "Component"
+		k.APIVersion = "kustomize.config.k8s.io/v1alpha1"
 	}
-	kf := filepath.Join(dir, "kustomization.yaml")
-	err = os.WriteFile(kf, b.Bytes(), 0666)
-	return err
+	return writeKustomizeFile(dir, k)
 }
 
 func getTeamFromFullPath(p string) (t, tp string) {
@@ -141,10 +195,14 @@ func processDirs(glob string, c Config, dp DirProcessor) error {
 func processDashboardDir(d string, c Config) error {
 	t, tp := getTeamFromFullPath(d)
 	as := copyMap(c.K8sAnnotations)
-	(*as)["team"] = t
 	(*as)["grafana.org/folder"] = t
-	rls := copyMap(c.K8sLabels)
-	(*rls)["team"] = t
+
+	td := filepath.Join(c.ManifestsDir, t)
+	if err := os.MkdirAll(td, 0775); err != nil {
+		return err
+	}
+	(*c.Teams)[t] = true
+	salt := fmt.Sprintf("%s|%s|%s|%s", c.K8sNamespace, mapFingerprint(*as), c.Validate, c.SchemaLocation)
 
 	err := filepath.Walk(d, func(path string, info os.FileInfo, err error) error {
 		if info.IsDir() || filepath.Ext(path) != ".json" {
@@ -155,16 +213,33 @@ func processDashboardDir(d string, c Config) error {
 		}
 		n := strings.TrimSuffix(filepath.Base(path), ".json")
 		pn := fmt.Sprintf("%s%s", tp, n)
-		mp := filepath.Join(c.ManifestsDir, fmt.Sprintf("%s.db.configmap.yaml", pn))
+		mp := filepath.Join(td, fmt.Sprintf("%s.db.configmap.yaml", pn))
 		_, err = validateManifestName(pn)
 		if err != nil {
 			return err
 		}
-		err = gdb2cm.ProcessDashboardFile(path, mp, c.K8sNamespace, pn, true, as)
+
+		h, err := hashFile(path, salt)
+		if err != nil {
+			return err
+		}
+		if unchanged(c.OldIndex, path, h, mp) {
+			(*c.NewIndex)[path] = c.OldIndex[path]
+			return nil
+		}
+		if err := removeStaleOutput(c.OldIndex, path, mp); err != nil {
+			return err
+		}
+
+		tmp := mp + ".tmp"
+		err = gdb2cm.ProcessDashboardFile(path, tmp, c.K8sNamespace, pn, true, as)
 		if err != nil {
 			return fmt.Errorf("%s is not valid: %v", path, err)
 		}
-		appendPath(path, &c)
+		if err := c.validateAndPlace(tmp, mp, "ConfigMap", "", "v1"); err != nil {
+			return err
+		}
+		(*c.NewIndex)[path] = manifestRecord{Hash: h, Output: mp}
 		return nil
 	})
 	return err
@@ -175,10 +250,12 @@ func processRulesDir(d string, c Config) error {
 	as := copyMap(c.K8sAnnotations)
 	rls := copyMap(c.K8sLabels)
 
-	if !(*c.RulesLabelsNoEnforceTeam)[t] {
-		(*rls)["team"] = t
+	td := filepath.Join(c.ManifestsDir, t)
+	if err := os.MkdirAll(td, 0775); err != nil {
+		return err
 	}
-	(*as)["team"] = t
+	(*c.Teams)[t] = true
+	salt := fmt.Sprintf("%s|%s|%s|%s|%s", c.K8sNamespace, mapFingerprint(*as), mapFingerprint(*rls), c.Validate, c.SchemaLocation)
 
 	err := filepath.Walk(d, func(path string, info os.FileInfo, err error) error {
 		if info.IsDir() || filepath.Ext(path) != ".yaml" {
@@ -189,75 +266,95 @@ func processRulesDir(d string, c Config) error {
 		}
 		n := strings.TrimSuffix(filepath.Base(path), ".yaml")
 		pn := fmt.Sprintf("%s%s", tp, n)
-		mp := filepath.Join(c.ManifestsDir, fmt.Sprintf("%s.prometheusrules.yaml", pn))
+		mp := filepath.Join(td, fmt.Sprintf("%s.prometheusrules.yaml", pn))
 		_, err = validateManifestName(pn)
 		if err != nil {
 			return err
 		}
-		err = pr2porm.ProcessRulesFile(path, mp, c.K8sNamespace, pn, rls, as)
+
+		h, err := hashFile(path, salt)
+		if err != nil {
+			return err
+		}
+		if unchanged(c.OldIndex, path, h, mp) {
+			(*c.NewIndex)[path] = c.OldIndex[path]
+			return nil
+		}
+		if err := removeStaleOutput(c.OldIndex, path, mp); err != nil {
+			return err
+		}
+
+		tmp := mp + ".tmp"
+		err = pr2porm.ProcessRulesFile(path, tmp, c.K8sNamespace, pn, rls, as)
 		if err != nil {
 			return fmt.Errorf("%s is not valid: %v", path, err)
 		}
-		appendPath(path, &c)
+		if err := c.validateAndPlace(tmp, mp, "PrometheusRule", "monitoring.coreos.com", "v1"); err != nil {
+			return err
+		}
+		(*c.NewIndex)[path] = manifestRecord{Hash: h, Output: mp}
 		return nil
 	})
 	return err
 }
 
-// appendPath writes a string to the .manifests file in the manifestsDir
-// this is used for pre-commit, which fails to track new files in some cases
-// the output of this file should be detirministic, because
-// filepath.Walk is used to walk the directories, and that function works in lexical order
-func appendPath(p string, c *Config) {
-	f, err := os.OpenFile(filepath.Join(c.ManifestsDir, ".manifests"),
-		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatal().Msg(fmt.Sprintf("failed to append to .manifests: %s", err.Error()))
+// unchanged reports whether path's content hash matches the old index entry
+// and that entry's output file is still on disk, so generation can be
+// skipped. The output of this file should be deterministic, because
+// filepath.Walk is used to walk the directories, and that function works in
+// lexical order.
+func unchanged(old map[string]manifestRecord, path, hash, output string) bool {
+	r, ok := old[path]
+	if !ok || r.Hash == "" || r.Hash != hash || r.Output != output {
+		return false
+	}
+	_, err := os.Stat(r.Output)
+	return err == nil
+}
+
+// removeStaleOutput deletes path's previously recorded output if this run
+// computed a different output path for it (e.g. a team/output layout
+// change), so the old file doesn't linger alongside the new one forever.
+func removeStaleOutput(old map[string]manifestRecord, path, output string) error {
+	r, ok := old[path]
+	if !ok || r.Output == "" || r.Output == output {
+		return nil
 	}
-	defer f.Close()
-	if _, err := f.WriteString(fmt.Sprintf("%s\n", p)); err != nil {
-		log.Fatal().Msg(fmt.Sprintf("failed to append to .manifests: %s", err.Error()))
+	if err := os.Remove(r.Output); err != nil && !os.IsNotExist(err) {
+		return err
 	}
+	return nil
 }
 
 func main() {
-	var err error
 	log.Logger = log.With().Caller().Logger()
 	kingpin.Parse()
 
-	err = cleanDir(*manifestsDir)
-	if err != nil {
-		log.Fatal().Msg(fmt.Sprintf("failed to clean manifestDir: %s", err.Error()))
+	if *validate != "" && *schemaLocation == "" {
+		log.Fatal().Msg("--schema-location is required when --validate is set")
 	}
 
-	c := Config{
+	base := Config{
 		ManifestsDir:             *manifestsDir,
 		K8sNamespace:             *k8sNamespace,
 		K8sAnnotations:           k8sAnnotations,
 		K8sLabels:                k8sLabels,
 		RulesLabelsNoEnforceTeam: &map[string]bool{},
+		Validate:                 *validate,
+		SchemaLocation:           *schemaLocation,
 	}
 
 	for _, t := range *rulesLabelsNoEnforceTeams {
-		(*c.RulesLabelsNoEnforceTeam)[t] = true
+		(*base.RulesLabelsNoEnforceTeam)[t] = true
 	}
 
-	if *dashboardsDirGlob != "" {
-		err = processDirs(*dashboardsDirGlob, c, processDashboardDir)
-		if err != nil {
-			log.Fatal().Err(err).Msg("")
-		}
+	if err := runOnce(base, *dashboardsDirGlob, *rulesDirGlob, *emit); err != nil {
+		log.Fatal().Err(err).Msg("")
 	}
 
-	if *rulesDirGlob != "" {
-		err = processDirs(*rulesDirGlob, c, processRulesDir)
-		if err != nil {
+	if *watchMode {
+		if err := watchDirs(base, *dashboardsDirGlob, *rulesDirGlob, *emit); err != nil {
 			log.Fatal().Err(err).Msg("")
 		}
 	}
-
-	err = generateKustomizeFile(*manifestsDir)
-	if err != nil {
-		log.Fatal().Err(err).Msg("")
-	}
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// jsonSchema is a pragmatic subset of JSON Schema (type/required/properties/
+// items/enum) - enough to catch the malformed-manifest mistakes kubeconform
+// catches (missing required fields, wrong field types) without pulling in a
+// full JSON Schema implementation as a dependency.
+type jsonSchema struct {
+	Type       string                 `json:"type"`
+	Required   []string               `json:"required"`
+	Properties map[string]*jsonSchema `json:"properties"`
+	Items      *jsonSchema            `json:"items"`
+	Enum       []interface{}          `json:"enum"`
+}
+
+// schemaFileName builds the kubeconform-style schema path for a
+// group/version/kind: "<kind>-<group>-<version>.json", lowercased, with the
+// group omitted for core resources like ConfigMap.
+func schemaFileName(kind, group, version string) string {
+	k := strings.ToLower(kind)
+	v := strings.ToLower(version)
+	if group == "" {
+		return fmt.Sprintf("%s-%s.json", k, v)
+	}
+	g := strings.ToLower(strings.ReplaceAll(group, ".", "-"))
+	return fmt.Sprintf("%s-%s-%s.json", k, g, v)
+}
+
+func loadSchema(path string) (*jsonSchema, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s jsonSchema
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// validate walks doc against the schema, returning an error naming the
+// JSON-pointer of the first field that doesn't conform.
+func (s *jsonSchema) validate(path string, v interface{}) error {
+	if s == nil {
+		return nil
+	}
+	if path == "" {
+		path = "/"
+	}
+	switch s.Type {
+	case "object":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected object", path)
+		}
+		for _, req := range s.Required {
+			if _, ok := m[req]; !ok {
+				return fmt.Errorf("%s: missing required field %q", path, req)
+			}
+		}
+		for k, cs := range s.Properties {
+			if cv, ok := m[k]; ok {
+				if err := cs.validate(strings.TrimSuffix(path, "/")+"/"+k, cv); err != nil {
+					return err
+				}
+			}
+		}
+	case "array":
+		a, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected array", path)
+		}
+		if s.Items != nil {
+			for i, item := range a {
+				if err := s.Items.validate(fmt.Sprintf("%s/%d", strings.TrimSuffix(path, "/"), i), item); err != nil {
+					return err
+				}
+			}
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%s: expected string", path)
+		}
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if e == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", path, v, s.Enum)
+		}
+	}
+	return nil
+}
+
+// validateManifest loads the schema for kind/group/version from
+// schemaLocation and validates the marshalled manifest against it.
+func validateManifest(schemaLocation, kind, group, version string, manifest []byte) error {
+	sp := filepath.Join(schemaLocation, schemaFileName(kind, group, version))
+	s, err := loadSchema(sp)
+	if err != nil {
+		return fmt.Errorf("could not load schema %s: %w", sp, err)
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(manifest, &doc); err != nil {
+		return err
+	}
+	return s.validate("", doc)
+}
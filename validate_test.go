@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSchemaFileName(t *testing.T) {
+	cases := []struct {
+		kind, group, version, want string
+	}{
+		{"ConfigMap", "", "v1", "configmap-v1.json"},
+		{"PrometheusRule", "monitoring.coreos.com", "v1", "prometheusrule-monitoring-coreos-com-v1.json"},
+	}
+	for _, c := range cases {
+		if got := schemaFileName(c.kind, c.group, c.version); got != c.want {
+			t.Errorf("schemaFileName(%q, %q, %q) = %q, want %q", c.kind, c.group, c.version, got, c.want)
+		}
+	}
+}
+
+func TestJSONSchemaValidate(t *testing.T) {
+	schema := &jsonSchema{
+		Type:     "object",
+		Required: []string{"spec"},
+		Properties: map[string]*jsonSchema{
+			"spec": {
+				Type:     "object",
+				Required: []string{"groups"},
+				Properties: map[string]*jsonSchema{
+					"groups": {
+						Type: "array",
+						Items: &jsonSchema{
+							Type:     "object",
+							Required: []string{"name"},
+							Properties: map[string]*jsonSchema{
+								"name": {Type: "string"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	t.Run("valid document passes", func(t *testing.T) {
+		doc := map[string]interface{}{
+			"spec": map[string]interface{}{
+				"groups": []interface{}{
+					map[string]interface{}{"name": "g1"},
+				},
+			},
+		}
+		if err := schema.validate("", doc); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("missing required field in array item reports a well-formed JSON pointer", func(t *testing.T) {
+		doc := map[string]interface{}{
+			"spec": map[string]interface{}{
+				"groups": []interface{}{
+					map[string]interface{}{"name": "g1"},
+					map[string]interface{}{},
+				},
+			},
+		}
+		err := schema.validate("", doc)
+		if err == nil {
+			t.Fatal("expected an error, got nil")
+		}
+		want := `/spec/groups/1: missing required field "name"`
+		if err.Error() != want {
+			t.Errorf("got %q, want %q", err.Error(), want)
+		}
+	})
+
+	t.Run("missing top-level required field", func(t *testing.T) {
+		err := schema.validate("", map[string]interface{}{})
+		if err == nil {
+			t.Fatal("expected an error, got nil")
+		}
+		want := `/: missing required field "spec"`
+		if err.Error() != want {
+			t.Errorf("got %q, want %q", err.Error(), want)
+		}
+	})
+
+	t.Run("enum mismatch", func(t *testing.T) {
+		s := &jsonSchema{Type: "string", Enum: []interface{}{"a", "b"}}
+		if err := s.validate("/kind", "c"); err == nil {
+			t.Fatal("expected an error, got nil")
+		}
+	})
+}
+
+func TestValidateManifest(t *testing.T) {
+	dir := t.TempDir()
+	schema := jsonSchema{
+		Type:     "object",
+		Required: []string{"kind"},
+		Properties: map[string]*jsonSchema{
+			"kind": {Type: "string"},
+		},
+	}
+	b, err := json.Marshal(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, schemaFileName("ConfigMap", "", "v1")), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := validateManifest(dir, "ConfigMap", "", "v1", []byte("kind: ConfigMap\n")); err != nil {
+		t.Errorf("expected valid manifest to pass, got: %v", err)
+	}
+	if err := validateManifest(dir, "ConfigMap", "", "v1", []byte("notkind: ConfigMap\n")); err == nil {
+		t.Error("expected invalid manifest to fail")
+	}
+	if err := validateManifest(dir, "Missing", "", "v1", []byte("{}")); err == nil {
+		t.Error("expected missing schema file to error")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// debounceWindow coalesces the burst of events a single save typically
+// produces (e.g. editors that write-then-rename) into one regeneration pass.
+const debounceWindow = 200 * time.Millisecond
+
+// runOnce regenerates every output whose input's content hash changed since
+// the last run (tracked in the manifestsDir's `.manifests` index), removes
+// outputs whose inputs disappeared, and rewrites the kustomization.yaml
+// files. base carries the static, run-independent config; its Teams,
+// OldIndex and NewIndex fields are filled in here.
+func runOnce(base Config, dashboardsGlob, rulesGlob, emit string) error {
+	if err := os.MkdirAll(base.ManifestsDir, 0775); err != nil {
+		return err
+	}
+	oldIdx, err := loadManifestIndex(base.ManifestsDir)
+	if err != nil {
+		return err
+	}
+
+	c := base
+	c.Teams = &map[string]bool{}
+	c.OldIndex = oldIdx
+	newIdx := map[string]manifestRecord{}
+	c.NewIndex = &newIdx
+
+	if dashboardsGlob != "" {
+		if err := processDirs(dashboardsGlob, c, processDashboardDir); err != nil {
+			return err
+		}
+	}
+	if rulesGlob != "" {
+		if err := processDirs(rulesGlob, c, processRulesDir); err != nil {
+			return err
+		}
+	}
+
+	for p, r := range oldIdx {
+		if _, ok := newIdx[p]; ok {
+			continue
+		}
+		log.Info().Msgf("%s no longer exists, removing generated %s", p, r.Output)
+		if err := os.Remove(r.Output); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(base.ManifestsDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || (*c.Teams)[e.Name()] {
+			continue
+		}
+		log.Info().Msgf("team %s has no remaining manifests, removing %s", e.Name(), filepath.Join(base.ManifestsDir, e.Name()))
+		if err := os.RemoveAll(filepath.Join(base.ManifestsDir, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	teams := make([]string, 0, len(*c.Teams))
+	for t := range *c.Teams {
+		teams = append(teams, t)
+		enforceTeamLabel := !(*base.RulesLabelsNoEnforceTeam)[t]
+		if err := generateTeamKustomizeFile(filepath.Join(base.ManifestsDir, t), t, base.K8sNamespace, enforceTeamLabel); err != nil {
+			return err
+		}
+	}
+	if err := generateRootKustomizeFile(base.ManifestsDir, teams, emit); err != nil {
+		return err
+	}
+
+	return writeManifestIndex(base.ManifestsDir, newIdx)
+}
+
+// watchDirs watches the directories matched by dashboardsGlob/rulesGlob and
+// reruns runOnce whenever a file changes, is created, removed, or renamed.
+// It blocks until the watcher is closed or errors out.
+func watchDirs(base Config, dashboardsGlob, rulesGlob, emit string) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	for _, glob := range []string{dashboardsGlob, rulesGlob} {
+		if glob == "" {
+			continue
+		}
+		dirs, err := filepath.Glob(glob)
+		if err != nil {
+			return err
+		}
+		for _, d := range dirs {
+			err := filepath.Walk(d, func(p string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.IsDir() {
+					return w.Add(p)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Info().Msg("watching for changes, press Ctrl+C to stop")
+	var debounce *time.Timer
+	var debounceC <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+				continue
+			}
+			if info, statErr := os.Stat(ev.Name); statErr == nil && info.IsDir() {
+				if err := w.Add(ev.Name); err != nil {
+					log.Error().Err(err).Msgf("failed to watch %s", ev.Name)
+				}
+				continue
+			}
+			log.Info().Msgf("%s changed, scheduling regeneration", ev.Name)
+			if debounce == nil {
+				debounce = time.NewTimer(debounceWindow)
+				debounceC = debounce.C
+			} else {
+				debounce.Reset(debounceWindow)
+			}
+		case <-debounceC:
+			log.Info().Msg("regenerating")
+			if err := runOnce(base, dashboardsGlob, rulesGlob, emit); err != nil {
+				log.Error().Err(err).Msg("regeneration failed")
+			}
+			debounce = nil
+			debounceC = nil
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			log.Error().Err(err).Msg("watcher error")
+		}
+	}
+}
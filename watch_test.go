@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestConfig builds a base Config suitable for runOnce, mirroring what
+// main() assembles from flags.
+func newTestConfig(manifestsDir string) Config {
+	return Config{
+		ManifestsDir:             manifestsDir,
+		K8sNamespace:             "monitoring",
+		K8sAnnotations:           &map[string]string{},
+		K8sLabels:                &map[string]string{},
+		RulesLabelsNoEnforceTeam: &map[string]bool{},
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRunOnceIdempotent runs the pipeline twice against the same inputs and
+// checks that the second pass doesn't regenerate a kustomization.yaml that
+// lists itself as one of its own resources.
+func TestRunOnceIdempotent(t *testing.T) {
+	root := t.TempDir()
+	dashDir := filepath.Join(root, "dashboards", "team-a", "folder1")
+	outDir := filepath.Join(root, "out")
+	writeFile(t, filepath.Join(dashDir, "d1.json"), `{"title":"test","panels":[]}`)
+
+	base := newTestConfig(outDir)
+	dashGlob := filepath.Join(root, "dashboards", "*", "*")
+
+	if err := runOnce(base, dashGlob, "", "base"); err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+	if err := runOnce(base, dashGlob, "", "base"); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+
+	r, err := generateKustomizeResources(filepath.Join(outDir, "team-a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range r {
+		if res == "kustomization.yaml" {
+			t.Error("team kustomization.yaml lists itself as a resource")
+		}
+	}
+}
+
+// TestRunOnceRemovesStaleOutputOnPathChange simulates an on-disk .manifests
+// record left over from before the per-team output layout existed, pointing
+// at a flat output path, and checks that a regeneration run cleans it up
+// instead of leaving it alongside the new per-team output.
+func TestRunOnceRemovesStaleOutputOnPathChange(t *testing.T) {
+	root := t.TempDir()
+	dashDir := filepath.Join(root, "dashboards", "team-a", "folder1")
+	outDir := filepath.Join(root, "out")
+	inputPath := filepath.Join(dashDir, "d1.json")
+	writeFile(t, inputPath, `{"title":"test","panels":[]}`)
+
+	staleOutput := filepath.Join(outDir, "team-a-d1.db.configmap.yaml")
+	writeFile(t, staleOutput, "stale")
+	if err := os.MkdirAll(outDir, 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeManifestIndex(outDir, map[string]manifestRecord{
+		inputPath: {Hash: "", Output: staleOutput},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	base := newTestConfig(outDir)
+	dashGlob := filepath.Join(root, "dashboards", "*", "*")
+	if err := runOnce(base, dashGlob, "", "base"); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	if _, err := os.Stat(staleOutput); !os.IsNotExist(err) {
+		t.Error("expected the stale flat-layout output to be removed")
+	}
+	newOutput := filepath.Join(outDir, "team-a", "team-a-d1.db.configmap.yaml")
+	if _, err := os.Stat(newOutput); err != nil {
+		t.Errorf("expected the new per-team output to exist: %v", err)
+	}
+}